@@ -0,0 +1,286 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ClusterCollectorConfig configures a ClusterCollector.
+type ClusterCollectorConfig struct {
+	// ZeroAddr is any reachable Zero endpoint; it is queried once to
+	// discover full cluster membership via /state.
+	ZeroAddr string
+	// PathPrefix is the directory results are written under, as
+	// PathPrefix/<group>/<node>/<profile-or-metric>.gz.
+	PathPrefix string
+	// Duration is how long CPU/trace-style profiles are sampled for.
+	Duration time.Duration
+	// Profiles is the set of pprof profile types to collect from every
+	// node. Defaults to every entry in pprofProfileTypes.
+	Profiles []string
+	// Metrics is the set of debug metrics to collect from every node.
+	// Defaults to every entry in metricTypes.
+	Metrics []string
+	// Concurrency bounds how many nodes are collected from at once.
+	// Defaults to 4.
+	Concurrency int
+	// PerNodeTimeout bounds how long collection from a single node may
+	// take before it's recorded as failed. Defaults to 2m.
+	PerNodeTimeout time.Duration
+
+	// ACLToken, if set, is sent as the X-Dgraph-AuthToken header on every
+	// request, so a single token configured here is reused across all
+	// nodes in the cluster.
+	ACLToken string
+	// TLSConfig, if set, is used for every node connection, letting
+	// operators configure one mTLS client certificate for the whole
+	// cluster snapshot rather than per node.
+	TLSConfig *tls.Config
+
+	// Process controls post-processing applied once every node has been
+	// collected from; only Merge is meaningful here, merging same-typed
+	// profiles across every node of a group.
+	Process ProcessOptions
+}
+
+// NodeSummary is the per-node outcome of a ClusterCollector run.
+type NodeSummary struct {
+	GroupID uint32
+	Addr    string
+	Leader  bool
+	IsZero  bool
+	Entries []manifestEntry
+	Err     error
+}
+
+// ClusterReport is the summary returned by ClusterCollector.Collect.
+type ClusterReport struct {
+	Nodes     []NodeSummary
+	Succeeded int
+	Failed    int
+	// Merged holds one aggregated manifestEntry per (group, profile type)
+	// when cfg.Process.Merge is set.
+	Merged []manifestEntry
+}
+
+type clusterTarget struct {
+	member stateMember
+	isZero bool
+}
+
+// ClusterCollector turns `dgraph debuginfo` into a one-shot cluster
+// snapshot tool: given a single Zero endpoint, it discovers every Alpha and
+// Zero member of the cluster and concurrently pulls the full profile and
+// metric set from each, suitable for bundling into a support ticket.
+type ClusterCollector struct {
+	cfg     ClusterCollectorConfig
+	fetcher *Fetcher
+}
+
+// NewClusterCollector builds a ClusterCollector from cfg, filling in
+// defaults and constructing the single Fetcher (carrying cfg.ACLToken and
+// cfg.TLSConfig) that every node fetch reuses.
+func NewClusterCollector(cfg ClusterCollectorConfig) *ClusterCollector {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 4
+	}
+	if cfg.PerNodeTimeout == 0 {
+		cfg.PerNodeTimeout = 2 * time.Minute
+	}
+	if cfg.Duration == 0 {
+		cfg.Duration = 30 * time.Second
+	}
+	if len(cfg.Profiles) == 0 {
+		cfg.Profiles = pprofProfileTypes
+	}
+	if len(cfg.Metrics) == 0 {
+		cfg.Metrics = metricTypes
+	}
+
+	return &ClusterCollector{
+		cfg: cfg,
+		fetcher: NewFetcher(FetcherConfig{
+			ACLToken:  cfg.ACLToken,
+			TLSConfig: cfg.TLSConfig,
+		}),
+	}
+}
+
+// Collect discovers cluster membership from cfg.ZeroAddr and gathers
+// profiles and metrics from every member with up to cfg.Concurrency nodes
+// in flight at once.
+func (c *ClusterCollector) Collect(ctx context.Context) (*ClusterReport, error) {
+	state, err := fetchState(ctx, c.fetcher, c.cfg.ZeroAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error while discovering cluster membership: %s", err)
+	}
+
+	var targets []clusterTarget
+	for _, group := range state.Groups {
+		for _, m := range group.Members {
+			targets = append(targets, clusterTarget{member: m, isZero: false})
+		}
+	}
+	for _, m := range state.Zeros {
+		targets = append(targets, clusterTarget{member: m, isZero: true})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no members found in cluster state from %s", c.cfg.ZeroAddr)
+	}
+
+	sem := make(chan struct{}, c.cfg.Concurrency)
+	var wg sync.WaitGroup
+	results := make([]NodeSummary, len(targets))
+
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t clusterTarget) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = NodeSummary{Addr: t.member.Addr, Err: ctx.Err()}
+				return
+			}
+			results[i] = c.collectNode(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	report := &ClusterReport{Nodes: results}
+	for _, r := range results {
+		if r.Err != nil {
+			glog.Errorf("cluster collector: %s: %s", r.Addr, r.Err)
+			report.Failed++
+			continue
+		}
+		report.Succeeded++
+	}
+
+	if c.cfg.Process.Merge {
+		report.Merged = c.mergeByGroupAndType(results)
+	}
+	return report, nil
+}
+
+// mergeByGroupAndType aggregates same-typed profiles (e.g. every "heap"
+// profile in group 1) across all of a group's nodes into one merged profile
+// per (group, type), written alongside the per-node dumps.
+func (c *ClusterCollector) mergeByGroupAndType(results []NodeSummary) []manifestEntry {
+	type key struct {
+		group uint32
+		zero  bool
+		name  string
+	}
+	paths := map[key][]string{}
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		for _, e := range r.Entries {
+			if !isPprofProfile(e.Name) {
+				continue
+			}
+			k := key{group: r.GroupID, zero: r.IsZero, name: e.Name}
+			paths[k] = append(paths[k], e.File)
+		}
+	}
+
+	var merged []manifestEntry
+	for k, files := range paths {
+		if len(files) < 2 {
+			continue
+		}
+		groupDir := "zero"
+		if !k.zero {
+			groupDir = fmt.Sprintf("group-%d", k.group)
+		}
+		outPath := filepath.Join(c.cfg.PathPrefix, groupDir, fmt.Sprintf("%s-merged.gz", k.name))
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			glog.Errorf("cluster collector: error creating %s: %s", filepath.Dir(outPath), err)
+			continue
+		}
+		entry, err := mergeProfileFiles(files, k.name+"-merged", outPath)
+		if err != nil {
+			glog.Errorf("cluster collector: error merging %s profiles for %s: %s", k.name, groupDir, err)
+			continue
+		}
+		merged = append(merged, *entry)
+	}
+	return merged
+}
+
+// collectNode gathers the full profile+metric set from a single member,
+// writing results under PathPrefix/<group>/<node>/, and enforces
+// cfg.PerNodeTimeout around the whole fetch. Canceling ctx (or cfg's
+// per-node timeout elapsing) aborts any fetch this node's goroutine still
+// has in flight, rather than only giving up on waiting for it.
+func (c *ClusterCollector) collectNode(ctx context.Context, t clusterTarget) NodeSummary {
+	summary := NodeSummary{GroupID: t.member.GroupID, Addr: t.member.Addr, Leader: t.member.Leader, IsZero: t.isZero}
+
+	nodeDir := filepath.Join(c.cfg.PathPrefix, groupDirName(t), sanitizeAddr(t.member.Addr))
+	if err := os.MkdirAll(nodeDir, 0755); err != nil {
+		summary.Err = fmt.Errorf("error while creating node dir: %s", err)
+		return summary
+	}
+	prefix := nodeDir + string(os.PathSeparator)
+
+	nodeCtx, cancel := context.WithTimeout(ctx, c.cfg.PerNodeTimeout)
+	defer cancel()
+
+	done := make(chan []manifestEntry, 1)
+	go func() {
+		entries := saveProfiles(nodeCtx, c.fetcher, t.member.Addr, prefix, c.cfg.Duration, c.cfg.Profiles)
+		entries = append(entries, saveMetrics(nodeCtx, c.fetcher, t.member.Addr, prefix, c.cfg.Duration, c.cfg.Metrics)...)
+		done <- entries
+	}()
+
+	select {
+	case entries := <-done:
+		summary.Entries = entries
+	case <-nodeCtx.Done():
+		summary.Err = fmt.Errorf("collecting from %s: %s", t.member.Addr, nodeCtx.Err())
+		return summary
+	}
+
+	if len(summary.Entries) == 0 {
+		summary.Err = fmt.Errorf("no profiles or metrics collected from %s", t.member.Addr)
+	}
+	return summary
+}
+
+func groupDirName(t clusterTarget) string {
+	if t.isZero {
+		return "zero"
+	}
+	return fmt.Sprintf("group-%d", t.member.GroupID)
+}
+
+func sanitizeAddr(addr string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(addr)
+}
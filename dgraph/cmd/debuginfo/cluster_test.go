@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeAddr(t *testing.T) {
+	require.Equal(t, "10.0.0.1_7080", sanitizeAddr("10.0.0.1:7080"))
+	require.Equal(t, "host_path_debug", sanitizeAddr("host/path:debug"))
+}
+
+func TestGroupDirName(t *testing.T) {
+	require.Equal(t, "zero", groupDirName(clusterTarget{isZero: true}))
+	require.Equal(t, "group-3", groupDirName(clusterTarget{member: stateMember{GroupID: 3}}))
+}
+
+func TestMergeByGroupAndType(t *testing.T) {
+	dir := t.TempDir()
+	c := &ClusterCollector{cfg: ClusterCollectorConfig{PathPrefix: dir}}
+
+	mkEntry := func(name string, value int64) manifestEntry {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d.gz", name, value))
+		_, err := writeProfile(sampleProfile(value), name, path)
+		require.NoError(t, err)
+		return manifestEntry{Name: name, File: path}
+	}
+
+	results := []NodeSummary{
+		{GroupID: 1, Entries: []manifestEntry{mkEntry("heap", 10)}},
+		{GroupID: 1, Entries: []manifestEntry{mkEntry("heap", 20)}},
+		{GroupID: 2, Entries: []manifestEntry{mkEntry("heap", 5)}},
+		{Err: fmt.Errorf("collection failed")},
+	}
+
+	merged := c.mergeByGroupAndType(results)
+
+	// Group 2 only contributed one file, so there's nothing to merge it
+	// against; only group 1's pair is merged.
+	require.Len(t, merged, 1)
+	require.Contains(t, merged[0].File, "group-1")
+
+	prof, err := readProfile(merged[0].File)
+	require.NoError(t, err)
+	require.Equal(t, int64(30), prof.Sample[0].Value[0])
+}
+
+func TestMergeByGroupAndTypeSkipsNonPprofEntries(t *testing.T) {
+	dir := t.TempDir()
+	c := &ClusterCollector{cfg: ClusterCollectorConfig{PathPrefix: dir}}
+
+	results := []NodeSummary{
+		{GroupID: 1, Entries: []manifestEntry{{Name: "state", File: filepath.Join(dir, "state.gz")}}},
+		{GroupID: 1, Entries: []manifestEntry{{Name: "state", File: filepath.Join(dir, "state2.gz")}}},
+	}
+
+	require.Empty(t, c.mergeByGroupAndType(results))
+}
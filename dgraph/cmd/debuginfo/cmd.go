@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+)
+
+// Cmd is the `dgraph debuginfo` subcommand: dgraph/cmd/root.go only needs
+// rootCmd.AddCommand(debuginfo.Cmd) to expose it. By default it collects a
+// single-host archive via PackageDebugInfo; passing --zero switches to
+// whole-cluster collection via ClusterCollector instead.
+var Cmd = &cobra.Command{
+	Use:   "debuginfo",
+	Short: "Collect profiles, metrics, and traces into a self-describing debuginfo archive",
+	RunE:  runDebugInfo,
+}
+
+var opt struct {
+	addr      string
+	zero      string
+	outDir    string
+	duration  time.Duration
+	profiles  []string
+	metrics   []string
+	aclToken  string
+	symbolize bool
+	delta     bool
+	merge     bool
+}
+
+func init() {
+	flag := Cmd.Flags()
+	flag.StringVar(&opt.addr, "addr", "localhost:8080", "Alpha/Zero address to collect debuginfo from")
+	flag.StringVar(&opt.zero, "zero", "",
+		"Zero address to discover cluster membership from; when set, collects from every member instead of just --addr")
+	flag.StringVar(&opt.outDir, "out", ".", "Directory the resulting archive is written to")
+	flag.DurationVar(&opt.duration, "duration", 30*time.Second, "How long CPU/trace-style profiles are sampled for")
+	flag.StringSliceVar(&opt.profiles, "profiles", nil, "Profile types to collect (defaults to every pprof profile type)")
+	flag.StringSliceVar(&opt.metrics, "metrics", nil, "Debug metrics to collect (defaults to every metric type)")
+	flag.StringVar(&opt.aclToken, "acl-token", "", "ACL token sent as X-Dgraph-AuthToken on every request")
+	flag.BoolVar(&opt.symbolize, "symbolize", false,
+		"Resolve bare addresses in collected profiles against /debug/pprof/symbol")
+	flag.BoolVar(&opt.delta, "delta", false,
+		"Additionally capture a heap delta between two samples --duration apart")
+	flag.BoolVar(&opt.merge, "merge", false, "With --zero, merge same-typed profiles collected across each group's nodes")
+}
+
+func runDebugInfo(cmd *cobra.Command, args []string) error {
+	process := ProcessOptions{Delta: opt.delta, Merge: opt.merge, Symbolize: opt.symbolize}
+
+	if opt.zero != "" {
+		return runClusterDebugInfo(cmd, process)
+	}
+
+	path, err := PackageDebugInfo(cmd.Context(), PackageConfig{
+		Addr:     opt.addr,
+		OutDir:   opt.outDir,
+		Duration: opt.duration,
+		Profiles: opt.profiles,
+		Metrics:  opt.metrics,
+		Process:  process,
+		Auth:     FetcherConfig{ACLToken: opt.aclToken},
+	})
+	if err != nil {
+		return fmt.Errorf("error while collecting debuginfo: %s", err)
+	}
+	glog.Infof("debuginfo: wrote archive to %s", path)
+	return nil
+}
+
+func runClusterDebugInfo(cmd *cobra.Command, process ProcessOptions) error {
+	collector := NewClusterCollector(ClusterCollectorConfig{
+		ZeroAddr:   opt.zero,
+		PathPrefix: opt.outDir,
+		Duration:   opt.duration,
+		Profiles:   opt.profiles,
+		Metrics:    opt.metrics,
+		ACLToken:   opt.aclToken,
+		Process:    process,
+	})
+	report, err := collector.Collect(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("error while collecting cluster debuginfo: %s", err)
+	}
+	glog.Infof("debuginfo: collected from %d/%d cluster members (%d failed)",
+		report.Succeeded, report.Succeeded+report.Failed, report.Failed)
+	return nil
+}
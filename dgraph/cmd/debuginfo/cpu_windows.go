@@ -0,0 +1,30 @@
+// +build windows
+
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"errors"
+	"time"
+)
+
+// processCPUTime is not implemented on windows; CPUThresholdPercent is
+// simply never triggered on that platform.
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("debuginfo: CPU time sampling is not supported on windows")
+}
@@ -17,6 +17,9 @@
 package debuginfo
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -39,65 +42,136 @@ var pprofProfileTypes = []string{
 	"trace",
 }
 
+// pprofParsableProfileTypes is pprofProfileTypes minus "trace": every entry
+// here is encoded in the github.com/google/pprof/profile protobuf format
+// readProfile can parse, whereas "trace" is the Go execution tracer's own
+// binary format (runtime/trace), a different thing entirely despite being
+// served from the same /debug/pprof/ namespace. Symbolizing or merging it
+// as a pprof profile always fails.
+var pprofParsableProfileTypes = []string{
+	"goroutine",
+	"heap",
+	"threadcreate",
+	"block",
+	"mutex",
+	"profile",
+}
+
 var metricTypes = []string{
 	"jemalloc",
 	"state",
 	"health",
 }
 
-func saveProfiles(addr, pathPrefix string, duration time.Duration, profiles []string) {
+// otlpMetricType is deliberately excluded from metricTypes: unlike the
+// others, it doesn't scrape addr over HTTP at all. StartOTLPCapture only
+// captures whatever this local collector process's own OpenTelemetry
+// providers emit, so it's only meaningful when addr is the collector's own
+// process. Callers that want it (e.g. an Alpha/Zero capturing its own
+// telemetry) must list it explicitly in PackageConfig.Metrics /
+// ClusterCollectorConfig.Metrics rather than getting it by default, since
+// the default list is shared with remote, possibly-clustered, targets.
+const otlpMetricType = "otlp"
+
+// saveProfiles fetches the requested pprof profiles from addr using f (the
+// defaultFetcher if nil) and returns a manifestEntry for each one that was
+// saved successfully. Entries are suitable for inclusion in a debuginfo
+// archive's manifest.json. Canceling ctx aborts any fetch still in flight.
+func saveProfiles(
+	ctx context.Context, f *Fetcher, addr, pathPrefix string, duration time.Duration, profiles []string,
+) []manifestEntry {
+	if f == nil {
+		f = defaultFetcher
+	}
 	u, err := url.Parse(addr)
 	if err != nil || (u.Host == "" && u.Scheme != "" && u.Scheme != "file") {
 		u, err = url.Parse("http://" + addr)
 	}
 	if err != nil || u.Host == "" {
 		glog.Errorf("error while parsing address %s: %s", addr, err)
-		return
+		return nil
 	}
 
+	var entries []manifestEntry
 	for _, profileType := range profiles {
 		source := fmt.Sprintf("%s/debug/pprof/%s?duration=%d", u.String(),
 			profileType, int(duration.Seconds()))
 		savePath := fmt.Sprintf("%s%s.gz", pathPrefix, profileType)
 
-		if err := saveDebug(source, savePath, duration); err != nil {
+		entry, err := saveDebug(ctx, f, source, savePath, duration)
+		if err != nil {
 			glog.Errorf("error while saving pprof profile from %s: %s", source, err)
 			continue
 		}
 
+		entry.Name = profileType
+		entries = append(entries, *entry)
 		glog.Infof("saving %s profile in %s", profileType, savePath)
 	}
+	return entries
 }
 
-func saveMetrics(addr, pathPrefix string, duration time.Duration, metrics []string) {
+// saveMetrics fetches the requested debug metrics (e.g. state, health) from
+// addr using f (the defaultFetcher if nil) and returns a manifestEntry for
+// each one that was saved successfully. Canceling ctx aborts any fetch
+// still in flight.
+func saveMetrics(
+	ctx context.Context, f *Fetcher, addr, pathPrefix string, duration time.Duration, metrics []string,
+) []manifestEntry {
+	if f == nil {
+		f = defaultFetcher
+	}
 	u, err := url.Parse(addr)
 	if err != nil || (u.Host == "" && u.Scheme != "" && u.Scheme != "file") {
 		u, err = url.Parse("http://" + addr)
 	}
 	if err != nil || u.Host == "" {
 		glog.Errorf("error while parsing address %s: %s", addr, err)
-		return
+		return nil
 	}
 
+	var entries []manifestEntry
 	for _, metricType := range metrics {
+		if metricType == otlpMetricType {
+			entry, err := saveOTLPCapture(ctx, addr, pathPrefix, duration)
+			if err != nil {
+				glog.Errorf("error while capturing otlp metrics/traces from %s: %s", addr, err)
+				continue
+			}
+			entries = append(entries, *entry)
+			glog.Infof("saving otlp capture in %s", entry.File)
+			continue
+		}
+
 		source := fmt.Sprintf("%s/%s", u.String(),
 			metricType)
 		savePath := fmt.Sprintf("%s%s.gz", pathPrefix, metricType)
 
-		if err := saveDebug(source, savePath, duration); err != nil {
+		entry, err := saveDebug(ctx, f, source, savePath, duration)
+		if err != nil {
 			glog.Errorf("error while saving metric from %s: %s", source, err)
 			continue
 		}
 
+		entry.Name = metricType
+		entries = append(entries, *entry)
 		glog.Infof("saving %s metric in %s", metricType, savePath)
 	}
+	return entries
 }
 
-// saveDebug writes the debug specified in the argument fetching it from the host
-// provided in the configuration
-func saveDebug(sourceURL, filePath string, duration time.Duration) error {
-	var err error
-	var resp io.ReadCloser
+// saveDebug writes the debug specified in the argument, fetching it via f
+// (the defaultFetcher if nil) from the host provided in the configuration.
+// On success it returns a manifestEntry describing the fetch (source,
+// duration, checksum) so callers can stitch together a manifest.json for a
+// debuginfo archive. Canceling ctx aborts the fetch if it's still in
+// flight.
+func saveDebug(
+	ctx context.Context, f *Fetcher, sourceURL, filePath string, duration time.Duration,
+) (*manifestEntry, error) {
+	if f == nil {
+		f = defaultFetcher
+	}
 
 	glog.Infof("fetching information over HTTP from %s", sourceURL)
 	if duration > 0 {
@@ -105,35 +179,34 @@ func saveDebug(sourceURL, filePath string, duration time.Duration) error {
 	}
 
 	timeout := duration + duration/2 + 2*time.Second
-	resp, err = fetchURL(sourceURL, timeout)
+	start := time.Now()
+	resp, err := f.fetchURL(ctx, sourceURL, timeout)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer resp.Close()
 	out, err := os.Create(filePath)
 	if err != nil {
-		return fmt.Errorf("error while creating dump file: %s", err)
+		return nil, fmt.Errorf("error while creating dump file: %s", err)
 	}
-	_, err = io.Copy(out, resp)
-	return err
-}
+	defer out.Close()
 
-// fetchURL fetches a profile from a URL using HTTP.
-func fetchURL(source string, timeout time.Duration) (io.ReadCloser, error) {
-	client := &http.Client{
-		Timeout: timeout,
-	}
-	resp, err := client.Get(source)
+	h := sha256.New()
+	size, err := io.Copy(out, io.TeeReader(resp, h))
 	if err != nil {
-		return nil, fmt.Errorf("http fetch: %v", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		defer resp.Body.Close()
-		return nil, statusCodeError(resp)
+		return nil, err
 	}
 
-	return resp.Body, nil
+	return &manifestEntry{
+		Source:     sourceURL,
+		File:       filePath,
+		FetchedAt:  start,
+		DurationMS: time.Since(start).Milliseconds(),
+		HTTPStatus: http.StatusOK,
+		SHA256:     hex.EncodeToString(h.Sum(nil)),
+		SizeBytes:  size,
+	}, nil
 }
 
 func statusCodeError(resp *http.Response) error {
@@ -144,4 +217,4 @@ func statusCodeError(resp *http.Response) error {
 		}
 	}
 	return fmt.Errorf("server response: %s", resp.Status)
-}
\ No newline at end of file
+}
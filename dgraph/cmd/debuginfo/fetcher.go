@@ -0,0 +1,292 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// FetcherConfig configures a Fetcher's authentication, retry, and safety
+// limits. A single Fetcher is typically built once per collector
+// (PackageDebugInfo, ClusterCollector) and reused for every profile and
+// metric it pulls; Watcher uses the shared defaultFetcher.
+type FetcherConfig struct {
+	// BearerToken, if set, is sent as an "Authorization: Bearer <token>"
+	// header.
+	BearerToken string
+	// BasicUser/BasicPass, if either is set, are sent as HTTP basic auth.
+	BasicUser string
+	BasicPass string
+	// ACLToken, if set, is sent as Dgraph's X-Dgraph-AuthToken header.
+	ACLToken string
+	// TLSConfig, if set, configures mTLS / custom CA verification for
+	// every request.
+	TLSConfig *tls.Config
+
+	// MaxBytes caps how much of a response body is read, so a runaway
+	// dump can't fill the disk. Zero means unlimited.
+	MaxBytes int64
+	// MaxRetries bounds how many times a request is retried after a 5xx
+	// response or a network-level error/timeout. Defaults to 3.
+	MaxRetries int
+	// RetryBackoff is the base delay before the first retry; each
+	// subsequent retry doubles it, plus jitter. Defaults to 500ms.
+	RetryBackoff time.Duration
+}
+
+// Fetcher is the single code path saveProfiles, saveMetrics, and
+// ClusterCollector all fetch debug endpoints through. Centralizing it here
+// means auth, retries, size caps, and gzip normalization are applied
+// consistently no matter which of those call it.
+type Fetcher struct {
+	cfg    FetcherConfig
+	client *http.Client
+}
+
+// NewFetcher builds a Fetcher from cfg, filling in retry defaults.
+func NewFetcher(cfg FetcherConfig) *Fetcher {
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 500 * time.Millisecond
+	}
+	return &Fetcher{
+		cfg:    cfg,
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: cfg.TLSConfig}},
+	}
+}
+
+// defaultFetcher is shared by every call site that doesn't need custom
+// auth, so the common case stays as simple as a bare HTTP GET.
+var defaultFetcher = NewFetcher(FetcherConfig{})
+
+// fetchURL performs a GET against source with bounded exponential-backoff
+// retry on 5xx responses and network errors, applies f's configured auth
+// headers, caps the response at cfg.MaxBytes, and normalizes the body to
+// always be gzip-compressed, so callers can keep naming files ".gz"
+// regardless of whether the source itself returned gzip (pprof dumps) or
+// plain JSON (/state, /health). ctx bounds the whole call, including every
+// retry; canceling it (e.g. a per-node timeout in ClusterCollector) aborts
+// an in-flight request instead of only preventing new ones from starting.
+func (f *Fetcher) fetchURL(ctx context.Context, source string, timeout time.Duration) (io.ReadCloser, error) {
+	body, err := f.fetchRaw(ctx, source, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeGzip(body)
+}
+
+func (f *Fetcher) fetchRaw(ctx context.Context, source string, timeout time.Duration) (io.ReadCloser, error) {
+	body, err := f.doWithRetry(ctx, http.MethodGet, source, nil, "", timeout)
+	if err != nil {
+		return nil, err
+	}
+	if f.cfg.MaxBytes > 0 {
+		body = &limitedReadCloser{r: io.LimitReader(body, f.cfg.MaxBytes), c: body}
+	}
+	return body, nil
+}
+
+// sleepCtx sleeps for d, returning early with ctx.Err() if ctx is canceled
+// first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// postRaw performs a POST against url with body, applying the same auth
+// headers, mTLS client, retry-with-backoff behavior, and MaxBytes cap as
+// fetchRaw. It's used for the handful of debug endpoints (e.g.
+// /debug/pprof/symbol) that take a request body instead of being plain
+// GETs. ctx bounds the whole call the same way it does in fetchRaw.
+func (f *Fetcher) postRaw(
+	ctx context.Context, url, contentType string, body []byte, timeout time.Duration,
+) (io.ReadCloser, error) {
+	resp, err := f.doWithRetry(ctx, http.MethodPost, url, body, contentType, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if f.cfg.MaxBytes > 0 {
+		resp = &limitedReadCloser{r: io.LimitReader(resp, f.cfg.MaxBytes), c: resp}
+	}
+	return resp, nil
+}
+
+// doWithRetry is the single retry-with-backoff loop fetchRaw and postRaw both
+// build on: it issues method against url (with body/contentType when set,
+// for postRaw's case), applies f's configured auth headers, and retries on a
+// 5xx response or network-level error up to cfg.MaxRetries times. ctx bounds
+// the whole call, including every retry and backoff sleep; canceling it
+// aborts an in-flight attempt instead of only preventing new ones from
+// starting.
+func (f *Fetcher) doWithRetry(
+	ctx context.Context, method, url string, body []byte, contentType string, timeout time.Duration,
+) (io.ReadCloser, error) {
+	var lastErr error
+	for attempt := 0; attempt <= f.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepCtx(ctx, f.backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, timeout)
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(reqCtx, method, url, bodyReader)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		f.setAuthHeaders(req)
+
+		resp, err := f.client.Do(req)
+		if err != nil {
+			cancel()
+			lastErr = fmt.Errorf("http fetch: %v", err)
+			continue
+		}
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			lastErr = fmt.Errorf("server response: %s - %s", resp.Status, readLimited(resp.Body))
+			resp.Body.Close()
+			cancel()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer cancel()
+			defer resp.Body.Close()
+			return nil, statusCodeError(resp)
+		}
+
+		return &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, nil
+	}
+	return nil, lastErr
+}
+
+func (f *Fetcher) setAuthHeaders(req *http.Request) {
+	if f.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+f.cfg.BearerToken)
+	}
+	if f.cfg.BasicUser != "" || f.cfg.BasicPass != "" {
+		req.SetBasicAuth(f.cfg.BasicUser, f.cfg.BasicPass)
+	}
+	if f.cfg.ACLToken != "" {
+		req.Header.Set("X-Dgraph-AuthToken", f.cfg.ACLToken)
+	}
+}
+
+// backoff returns the delay before retry attempt n (1-indexed): cfg.RetryBackoff
+// doubled n-1 times, plus up to 50% jitter so a fleet of collectors hitting
+// the same flaky node don't all retry in lockstep.
+func (f *Fetcher) backoff(attempt int) time.Duration {
+	base := f.cfg.RetryBackoff * time.Duration(int64(1)<<uint(attempt-1))
+	jitter := time.Duration(rand.Int63n(int64(base)/2 + 1))
+	return base + jitter
+}
+
+func readLimited(r io.Reader) string {
+	body, err := ioutil.ReadAll(io.LimitReader(r, 4<<10))
+	if err != nil {
+		return "<unreadable body>"
+	}
+	return string(body)
+}
+
+// limitedReadCloser caps how many bytes can be read from the underlying
+// response body while still closing the real connection on Close.
+type limitedReadCloser struct {
+	r io.Reader
+	c io.Closer
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) { return l.r.Read(p) }
+func (l *limitedReadCloser) Close() error               { return l.c.Close() }
+
+// cancelOnClose cancels the request's context once the caller is done
+// reading the body, so a per-attempt context from the retry loop doesn't
+// leak past it.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// normalizeGzip returns body re-wrapped so the stream is always
+// gzip-compressed, streaming the compression rather than buffering the
+// whole response in memory. Profiles fetched from /debug/pprof/* already
+// arrive gzip-compressed and pass through unchanged; /state and /health
+// return plain JSON and are gzipped on the fly.
+func normalizeGzip(body io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		body.Close()
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return &readCloser{Reader: br, Closer: body}, nil
+	}
+
+	pr, pw := io.Pipe()
+	gz := gzip.NewWriter(pw)
+	go func() {
+		_, copyErr := io.Copy(gz, br)
+		closeErr := gz.Close()
+		if copyErr == nil {
+			copyErr = closeErr
+		}
+		pw.CloseWithError(copyErr)
+		body.Close()
+	}()
+	return pr, nil
+}
+
+// readCloser pairs an independent Reader and Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetcherAuthHeaders(t *testing.T) {
+	var gotAuth, gotBasicUser, gotBasicPass, gotACL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		if u, p, ok := r.BasicAuth(); ok {
+			gotBasicUser, gotBasicPass = u, p
+		}
+		gotACL = r.Header.Get("X-Dgraph-AuthToken")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{BearerToken: "tok", ACLToken: "acl-tok"})
+	resp, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	require.Equal(t, "Bearer tok", gotAuth)
+	require.Equal(t, "acl-tok", gotACL)
+	require.Empty(t, gotBasicUser)
+	require.Empty(t, gotBasicPass)
+}
+
+func TestFetcherBasicAuth(t *testing.T) {
+	var gotUser, gotPass string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{BasicUser: "alice", BasicPass: "hunter2"})
+	resp, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.NoError(t, err)
+	resp.Close()
+
+	require.Equal(t, "alice", gotUser)
+	require.Equal(t, "hunter2", gotPass)
+}
+
+func TestFetcherRetriesOn5xx(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("eventually ok"))
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{MaxRetries: 3, RetryBackoff: time.Millisecond})
+	resp, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	require.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+}
+
+func TestFetcherGivesUpAfterMaxRetries(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	_, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.Error(t, err)
+	require.EqualValues(t, 3, atomic.LoadInt32(&attempts)) // initial attempt + 2 retries
+}
+
+func TestFetcherNon5xxErrorIsNotRetried(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{MaxRetries: 3, RetryBackoff: time.Millisecond})
+	_, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.Error(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&attempts))
+}
+
+func TestFetcherMaxBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, 1<<20))
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{MaxBytes: 1024})
+	resp, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	gz, err := gzip.NewReader(resp)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(body), 1024)
+}
+
+func TestFetcherNormalizesNonGzipBodyToGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"version":"v1"}`))
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{})
+	resp, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	gz, err := gzip.NewReader(resp)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version":"v1"}`, string(body))
+}
+
+func TestFetcherPostRawSendsAuthAndBody(t *testing.T) {
+	var gotAuth, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("X-Dgraph-AuthToken")
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(b)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("0x1 main.foo"))
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{ACLToken: "acl-tok"})
+	resp, err := f.postRaw(context.Background(), srv.URL, "text/plain", []byte("0x1"), time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	require.Equal(t, "acl-tok", gotAuth)
+	require.Equal(t, "0x1", gotBody)
+}
+
+func TestFetcherPostRawMaxBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, 1<<20))
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{MaxBytes: 1024})
+	resp, err := f.postRaw(context.Background(), srv.URL, "text/plain", []byte("0x1"), time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	body, err := ioutil.ReadAll(resp)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(body), 1024)
+}
+
+func TestFetcherPostRawRetriesOn5xx(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	resp, err := f.postRaw(context.Background(), srv.URL, "text/plain", []byte("0x1"), time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	require.EqualValues(t, 2, atomic.LoadInt32(&attempts))
+}
+
+func TestFetcherFetchURLAbortsOnCanceledContext(t *testing.T) {
+	blockCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blockCh
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	defer close(blockCh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := NewFetcher(FetcherConfig{}).fetchURL(ctx, srv.URL, 10*time.Second)
+		errCh <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetchURL did not return after its context was canceled")
+	}
+}
+
+func TestFetcherPassesThroughAlreadyGzippedBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte("raw pprof bytes"))
+		_ = gz.Close()
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(FetcherConfig{})
+	resp, err := f.fetchURL(context.Background(), srv.URL, time.Second)
+	require.NoError(t, err)
+	defer resp.Close()
+
+	gz, err := gzip.NewReader(resp)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, "raw pprof bytes", string(body))
+}
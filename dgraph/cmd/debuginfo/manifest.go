@@ -0,0 +1,49 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import "time"
+
+const manifestFileName = "manifest.json"
+
+// manifestEntry describes a single file captured into a debuginfo archive.
+// It follows the pprof "sources" convention (URL + timestamp + duration),
+// so entries can still be opened directly off the archive, e.g.
+// `go tool pprof <archive>#heap`.
+type manifestEntry struct {
+	// Name is the profile or metric type, e.g. "heap" or "state".
+	Name       string    `json:"name"`
+	Source     string    `json:"source"`
+	File       string    `json:"file"`
+	FetchedAt  time.Time `json:"fetched_at"`
+	DurationMS int64     `json:"duration_ms"`
+	HTTPStatus int       `json:"http_status"`
+	SHA256     string    `json:"sha256"`
+	SizeBytes  int64     `json:"size_bytes"`
+}
+
+// manifest is the top-level manifest.json bundled into every archive
+// produced by PackageDebugInfo. It lets support engineers figure out what a
+// dgraph-debuginfo-*.tar.zst archive contains without unpacking it first.
+type manifest struct {
+	Host         string          `json:"host"`
+	Addr         string          `json:"addr"`
+	BuildVersion string          `json:"build_version,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	Entries      []manifestEntry `json:"entries"`
+	Errors       []string        `json:"errors,omitempty"`
+}
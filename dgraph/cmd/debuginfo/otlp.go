@@ -0,0 +1,270 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	collectormetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// saveOTLPCapture drives an OTLP capture for duration and writes it to
+// <pathPrefix>otlp.pb, returning a manifestEntry describing the result. It
+// is the "otlp" branch of saveMetrics. Unlike every other branch, addr
+// isn't actually fetched from: the capture only ever observes this local
+// collector process's own telemetry, so it's only meaningful when addr
+// names the collector's own process (see otlpMetricType and
+// StartOTLPCapture). Canceling ctx (e.g. a per-node timeout) aborts the
+// capture early instead of letting it run for the full duration.
+func saveOTLPCapture(ctx context.Context, addr, pathPrefix string, duration time.Duration) (*manifestEntry, error) {
+	savePath := fmt.Sprintf("%sotlp.pb", pathPrefix)
+	out, err := os.Create(savePath)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating otlp capture file: %s", err)
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(out, h)}
+
+	start := time.Now()
+	if err := StartOTLPCapture(ctx, addr, duration, cw); err != nil {
+		return nil, err
+	}
+
+	return &manifestEntry{
+		Name:       "otlp",
+		Source:     fmt.Sprintf("otlp-capture://%s", addr),
+		File:       savePath,
+		FetchedAt:  start,
+		DurationMS: time.Since(start).Milliseconds(),
+		SHA256:     hex.EncodeToString(h.Sum(nil)),
+		SizeBytes:  cw.n,
+	}, nil
+}
+
+// otlpCaptureMu serializes StartOTLPCapture calls within this process.
+// Dgraph's otel.SetMeterProvider/SetTracerProvider are global singletons,
+// so two overlapping captures would otherwise race: whichever finishes
+// first restores the pre-capture provider out from under the other,
+// silently truncating or killing it.
+var otlpCaptureMu sync.Mutex
+
+// StartOTLPCapture stands up an in-process OTLP/gRPC receiver on an
+// ephemeral local port, points Dgraph's OpenTelemetry metric and trace
+// providers at it for dur, then restores the previous providers, flushes
+// the capture, and writes everything the receiver collected to out as a
+// sequence of length-delimited OTLP ExportMetricsServiceRequest and
+// ExportTraceServiceRequest protobuf messages (metrics first, then
+// traces). endpoint is carried through only as a label identifying which
+// server this capture belongs to; the exporters always talk to the local
+// receiver, never the network, so this only ever captures telemetry that
+// this local process itself emits — it cannot be used to pull OTLP data
+// out of a remote Alpha/Zero. Calls are serialized by otlpCaptureMu, since
+// the providers it swaps are process-global.
+//
+// This gives operators a portable trace/metric capture during an incident
+// that can be replayed into Tempo/Jaeger/Prometheus, rather than only the
+// Go-runtime-flavored pprof data saveProfiles collects.
+func StartOTLPCapture(ctx context.Context, endpoint string, dur time.Duration, out io.Writer) error {
+	otlpCaptureMu.Lock()
+	defer otlpCaptureMu.Unlock()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error while starting otlp receiver: %s", err)
+	}
+
+	mRecv := &metricsReceiver{}
+	tRecv := &traceReceiver{}
+
+	srv := grpc.NewServer()
+	collectormetricpb.RegisterMetricsServiceServer(srv, mRecv)
+	collectortracepb.RegisterTraceServiceServer(srv, tRecv)
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			glog.V(2).Infof("otlp capture: receiver for %s stopped: %s", endpoint, err)
+		}
+	}()
+
+	mExp, err := otlpmetricgrpc.New(ctx,
+		otlpmetricgrpc.WithEndpoint(lis.Addr().String()),
+		otlpmetricgrpc.WithInsecure())
+	if err != nil {
+		srv.Stop()
+		return fmt.Errorf("error while creating otlp metric exporter: %s", err)
+	}
+	tExp, err := otlptracegrpc.New(ctx,
+		otlptracegrpc.WithEndpoint(lis.Addr().String()),
+		otlptracegrpc.WithInsecure())
+	if err != nil {
+		srv.Stop()
+		return fmt.Errorf("error while creating otlp trace exporter: %s", err)
+	}
+
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(mExp, sdkmetric.WithInterval(2*time.Second))))
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(tExp))
+
+	prevMeterProvider := otel.GetMeterProvider()
+	prevTracerProvider := otel.GetTracerProvider()
+	otel.SetMeterProvider(meterProvider)
+	otel.SetTracerProvider(tracerProvider)
+
+	glog.Infof("otlp capture: pointing metric/trace providers at %s for %s", endpoint, dur)
+	select {
+	case <-time.After(dur):
+	case <-ctx.Done():
+	}
+
+	otel.SetMeterProvider(prevMeterProvider)
+	otel.SetTracerProvider(prevTracerProvider)
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := meterProvider.ForceFlush(flushCtx); err != nil {
+		glog.Errorf("otlp capture: error flushing metrics: %s", err)
+	}
+	if err := meterProvider.Shutdown(flushCtx); err != nil {
+		glog.Errorf("otlp capture: error shutting down meter provider: %s", err)
+	}
+	if err := tracerProvider.ForceFlush(flushCtx); err != nil {
+		glog.Errorf("otlp capture: error flushing traces: %s", err)
+	}
+	if err := tracerProvider.Shutdown(flushCtx); err != nil {
+		glog.Errorf("otlp capture: error shutting down tracer provider: %s", err)
+	}
+
+	srv.GracefulStop()
+
+	return writeOTLPCapture(out, mRecv.take(), tRecv.take())
+}
+
+// countingWriter wraps an io.Writer to track the number of bytes written to
+// it, used to populate manifestEntry.SizeBytes alongside a running SHA-256.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// metricsReceiver is a minimal in-process implementation of the OTLP
+// collector MetricsService, used only to capture whatever Dgraph's
+// providers push during the capture window.
+type metricsReceiver struct {
+	collectormetricpb.UnimplementedMetricsServiceServer
+
+	mu   sync.Mutex
+	reqs []*collectormetricpb.ExportMetricsServiceRequest
+}
+
+func (r *metricsReceiver) Export(
+	_ context.Context, req *collectormetricpb.ExportMetricsServiceRequest,
+) (*collectormetricpb.ExportMetricsServiceResponse, error) {
+	r.mu.Lock()
+	r.reqs = append(r.reqs, req)
+	r.mu.Unlock()
+	return &collectormetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func (r *metricsReceiver) take() []*collectormetricpb.ExportMetricsServiceRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reqs
+}
+
+// traceReceiver is the trace counterpart of metricsReceiver.
+type traceReceiver struct {
+	collectortracepb.UnimplementedTraceServiceServer
+
+	mu   sync.Mutex
+	reqs []*collectortracepb.ExportTraceServiceRequest
+}
+
+func (r *traceReceiver) Export(
+	_ context.Context, req *collectortracepb.ExportTraceServiceRequest,
+) (*collectortracepb.ExportTraceServiceResponse, error) {
+	r.mu.Lock()
+	r.reqs = append(r.reqs, req)
+	r.mu.Unlock()
+	return &collectortracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (r *traceReceiver) take() []*collectortracepb.ExportTraceServiceRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reqs
+}
+
+// writeOTLPCapture writes every captured request to out, length-delimited
+// (a 4-byte big-endian length prefix followed by the marshaled message),
+// metrics first and then traces.
+func writeOTLPCapture(
+	out io.Writer,
+	metrics []*collectormetricpb.ExportMetricsServiceRequest,
+	traces []*collectortracepb.ExportTraceServiceRequest,
+) error {
+	for _, m := range metrics {
+		if err := writeLengthDelimited(out, m); err != nil {
+			return fmt.Errorf("error while writing otlp metrics capture: %s", err)
+		}
+	}
+	for _, t := range traces {
+		if err := writeLengthDelimited(out, t); err != nil {
+			return fmt.Errorf("error while writing otlp trace capture: %s", err)
+		}
+	}
+	return nil
+}
+
+func writeLengthDelimited(out io.Writer, msg proto.Message) error {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := out.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	return err
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/glog"
+)
+
+// PackageConfig controls a single-host debuginfo collection run. It is the
+// config struct behind both `dgraph debuginfo` run without --zero (which
+// always writes an archive; the command has no separate --archive flag) and
+// the PackageDebugInfo API that Alpha/Zero admin tooling can call directly.
+type PackageConfig struct {
+	// Addr is the host:port (or URL) of the Alpha/Zero whose debug
+	// endpoints should be scraped.
+	Addr string
+	// OutDir is the directory the resulting archive is written to.
+	// Defaults to the current working directory.
+	OutDir string
+	// Duration is how long CPU/trace-style profiles are sampled for.
+	Duration time.Duration
+	// Profiles is the set of pprof profile types to collect. Defaults to
+	// every entry in pprofProfileTypes.
+	Profiles []string
+	// Metrics is the set of debug metrics to collect. Defaults to every
+	// entry in metricTypes.
+	Metrics []string
+	// Process controls post-processing (delta heap profiles,
+	// symbolization) applied on top of the raw dumps.
+	Process ProcessOptions
+	// Auth configures authentication, retries, and size caps shared by
+	// every fetch this run makes.
+	Auth FetcherConfig
+}
+
+// stateResponse mirrors the handful of fields the debuginfo package cares
+// about from Zero's /state endpoint (dgraph's MembershipState); the real
+// payload has many more.
+type stateResponse struct {
+	Version string                 `json:"version"`
+	Groups  map[string]stateGroup  `json:"groups"`
+	Zeros   map[string]stateMember `json:"zeros"`
+}
+
+// stateGroup is one Raft group's membership, as reported under
+// stateResponse.Groups.
+type stateGroup struct {
+	Members map[string]stateMember `json:"members"`
+}
+
+// stateMember is a single Alpha or Zero member of the cluster.
+type stateMember struct {
+	ID      string `json:"id"`
+	GroupID uint32 `json:"groupId"`
+	Addr    string `json:"addr"`
+	Leader  bool   `json:"leader"`
+}
+
+// PackageDebugInfo collects the profiles and metrics described by cfg from a
+// single host and bundles them into one self-describing
+// dgraph-debuginfo-<host>-<ts>.tar.zst archive under cfg.OutDir. Alongside
+// the raw .gz dumps, the archive carries a manifest.json with the SHA-256
+// of every entry and, for entries fetched over HTTP, the source URL, fetch
+// duration and HTTP status, plus the
+// server's build version pulled from /state, so the archive is easy to
+// triage without re-running the collection. Canceling ctx aborts any fetch
+// still in flight, the same as ClusterCollector.Collect.
+func PackageDebugInfo(ctx context.Context, cfg PackageConfig) (path string, err error) {
+	if cfg.Duration == 0 {
+		cfg.Duration = 30 * time.Second
+	}
+	if len(cfg.Profiles) == 0 {
+		cfg.Profiles = pprofProfileTypes
+	}
+	if len(cfg.Metrics) == 0 {
+		cfg.Metrics = metricTypes
+	}
+	if cfg.OutDir == "" {
+		cfg.OutDir = "."
+	}
+	if err := os.MkdirAll(cfg.OutDir, 0755); err != nil {
+		return "", fmt.Errorf("error while creating out dir: %s", err)
+	}
+
+	workDir, err := ioutil.TempDir("", "dgraph-debuginfo-")
+	if err != nil {
+		return "", fmt.Errorf("error while creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	host := hostFromAddr(cfg.Addr)
+	prefix := filepath.Join(workDir, host+"-")
+	fetcher := NewFetcher(cfg.Auth)
+
+	var errs []string
+	entries := saveProfiles(ctx, fetcher, cfg.Addr, prefix, cfg.Duration, cfg.Profiles)
+	entries = append(entries, saveMetrics(ctx, fetcher, cfg.Addr, prefix, cfg.Duration, cfg.Metrics)...)
+	if len(entries) == 0 {
+		errs = append(errs, "no profiles or metrics were collected successfully")
+	}
+
+	if cfg.Process.Symbolize {
+		for i := range entries {
+			if !isPprofProfile(entries[i].Name) {
+				continue
+			}
+			if err := symbolizeEntry(ctx, fetcher, cfg.Addr, &entries[i]); err != nil {
+				glog.Errorf("error while symbolizing %s: %s", entries[i].File, err)
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if cfg.Process.Delta {
+		deltaEntry, err := captureHeapDelta(ctx, fetcher, cfg.Addr, prefix, cfg.Duration)
+		if err != nil {
+			glog.Errorf("error while capturing heap delta: %s", err)
+			errs = append(errs, err.Error())
+		} else {
+			if cfg.Process.Symbolize {
+				if err := symbolizeEntry(ctx, fetcher, cfg.Addr, deltaEntry); err != nil {
+					glog.Errorf("error while symbolizing %s: %s", deltaEntry.File, err)
+					errs = append(errs, err.Error())
+				}
+			}
+			entries = append(entries, *deltaEntry)
+		}
+	}
+
+	buildVersion, err := fetchBuildVersion(ctx, fetcher, cfg.Addr)
+	if err != nil {
+		glog.Errorf("error while fetching build version from %s: %s", cfg.Addr, err)
+		errs = append(errs, err.Error())
+	}
+
+	m := manifest{
+		Host:         host,
+		Addr:         cfg.Addr,
+		BuildVersion: buildVersion,
+		CreatedAt:    time.Now().UTC(),
+		Entries:      entries,
+		Errors:       errs,
+	}
+	manifestBytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error while marshaling manifest: %s", err)
+	}
+	manifestPath := filepath.Join(workDir, manifestFileName)
+	if err := ioutil.WriteFile(manifestPath, manifestBytes, 0644); err != nil {
+		return "", fmt.Errorf("error while writing manifest: %s", err)
+	}
+
+	ts := time.Now().UTC().Format("20060102T150405Z")
+	archivePath := filepath.Join(cfg.OutDir, fmt.Sprintf("dgraph-debuginfo-%s-%s.tar.zst", host, ts))
+	if err := tarZstDir(workDir, archivePath); err != nil {
+		return "", fmt.Errorf("error while archiving debuginfo: %s", err)
+	}
+
+	glog.Infof("wrote debuginfo archive to %s", archivePath)
+	return archivePath, nil
+}
+
+// hostFromAddr extracts a filesystem-friendly host identifier from addr,
+// falling back to the raw addr if it can't be parsed as a URL.
+func hostFromAddr(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Hostname() == "" {
+		u, err = url.Parse("http://" + addr)
+	}
+	if err != nil || u.Hostname() == "" {
+		return addr
+	}
+	return u.Hostname()
+}
+
+// fetchState hits /state on addr via f (the defaultFetcher if nil) and
+// decodes the cluster's membership state, shared by PackageDebugInfo (for
+// the build version) and ClusterCollector (for membership discovery).
+// Canceling ctx aborts the fetch if it's still in flight.
+func fetchState(ctx context.Context, f *Fetcher, addr string) (*stateResponse, error) {
+	if f == nil {
+		f = defaultFetcher
+	}
+	u, err := url.Parse(addr)
+	if err != nil || (u.Host == "" && u.Scheme != "" && u.Scheme != "file") {
+		u, err = url.Parse("http://" + addr)
+	}
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("error while parsing address %s: %s", addr, err)
+	}
+
+	resp, err := f.fetchRaw(ctx, fmt.Sprintf("%s/state", u.String()), 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	var state stateResponse
+	if err := json.NewDecoder(resp).Decode(&state); err != nil {
+		return nil, fmt.Errorf("error while decoding /state response: %s", err)
+	}
+	return &state, nil
+}
+
+// fetchBuildVersion hits /state and pulls out the server's reported build
+// version, for inclusion in the archive manifest.
+func fetchBuildVersion(ctx context.Context, f *Fetcher, addr string) (string, error) {
+	state, err := fetchState(ctx, f, addr)
+	if err != nil {
+		return "", err
+	}
+	return state.Version, nil
+}
+
+// tarZstDir writes every regular file under srcDir into a zstd-compressed
+// tar archive at dstPath.
+func tarZstDir(srcDir, dstPath string) error {
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zstd.NewWriter(out)
+	defer zw.Close()
+
+	tw := tar.NewWriter(zw)
+	defer tw.Close()
+
+	entries, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if fi.IsDir() {
+			continue
+		}
+		if err := addFileToTar(tw, filepath.Join(srcDir, fi.Name()), fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToTar(tw *tar.Writer, path string, fi os.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/pprof/profile"
+)
+
+// ProcessOptions controls post-processing applied to raw profiles after
+// they've been downloaded. Delta and Merge add extra, derived entries next
+// to the plain .gz dumps saveProfiles/saveMetrics already produce;
+// Symbolize rewrites those profile dumps in place.
+type ProcessOptions struct {
+	// Delta additionally captures a second heap sample and writes the
+	// difference against the first, the standard way to attribute a leak
+	// instead of staring at a single-shot heap dump.
+	Delta bool
+	// Merge combines same-typed profiles collected from every node of a
+	// Raft group into one aggregated profile.
+	Merge bool
+	// Symbolize resolves bare addresses against /debug/pprof/symbol for
+	// profiles that were collected without symbol info attached.
+	Symbolize bool
+}
+
+// readProfile loads a previously saved (optionally gzip-compressed) pprof
+// profile from disk.
+func readProfile(path string) (*profile.Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return profile.Parse(f)
+}
+
+// writeProfile gzip-encodes prof (via the pprof library's own Write, which
+// always gzips) to path and returns a manifestEntry describing it.
+func writeProfile(prof *profile.Profile, name, path string) (*manifestEntry, error) {
+	var buf bytes.Buffer
+	if err := prof.Write(&buf); err != nil {
+		return nil, fmt.Errorf("error while encoding profile: %s", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("error while writing profile: %s", err)
+	}
+
+	h := sha256.Sum256(buf.Bytes())
+	return &manifestEntry{
+		Name:      name,
+		File:      path,
+		FetchedAt: time.Now(),
+		SHA256:    hex.EncodeToString(h[:]),
+		SizeBytes: int64(buf.Len()),
+	}, nil
+}
+
+// captureHeapDelta fetches two successive heap samples from addr a short
+// interval apart and writes their difference to <prefix>heap-delta.gz. This
+// is the primary way operators attribute a leak instead of guessing from a
+// single-shot dump.
+func captureHeapDelta(ctx context.Context, f *Fetcher, addr, prefix string, duration time.Duration) (*manifestEntry, error) {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Host == "" && u.Scheme != "" && u.Scheme != "file") {
+		u, err = url.Parse("http://" + addr)
+	}
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("error while parsing address %s: %s", addr, err)
+	}
+	heapURL := fmt.Sprintf("%s/debug/pprof/heap", u.String())
+
+	baseEntry, err := saveDebug(ctx, f, heapURL, prefix+"heap-base.gz", 0)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching base heap sample: %s", err)
+	}
+	if err := sleepCtx(ctx, duration); err != nil {
+		return nil, fmt.Errorf("error while waiting between heap samples: %s", err)
+	}
+	currEntry, err := saveDebug(ctx, f, heapURL, prefix+"heap-current.gz", 0)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching current heap sample: %s", err)
+	}
+
+	base, err := readProfile(baseEntry.File)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading base heap sample: %s", err)
+	}
+	curr, err := readProfile(currEntry.File)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading current heap sample: %s", err)
+	}
+
+	delta, err := diffProfiles(curr, base)
+	if err != nil {
+		return nil, fmt.Errorf("error while diffing heap samples: %s", err)
+	}
+
+	entry, err := writeProfile(delta, "heap-delta", prefix+"heap-delta.gz")
+	if err != nil {
+		return nil, err
+	}
+	entry.Source = fmt.Sprintf("%s/debug/pprof/heap (delta)", addr)
+	return entry, nil
+}
+
+// diffProfiles returns curr with base's samples subtracted out, following
+// the same technique `go tool pprof -base` uses: negate base's sample
+// values, then merge.
+func diffProfiles(curr, base *profile.Profile) (*profile.Profile, error) {
+	ratios := make([]float64, len(base.SampleType))
+	for i := range ratios {
+		ratios[i] = -1
+	}
+	if err := base.ScaleN(ratios); err != nil {
+		return nil, fmt.Errorf("error while negating base sample: %s", err)
+	}
+	return profile.Merge([]*profile.Profile{curr, base})
+}
+
+// mergeProfileFiles merges the profiles at paths (typically one file per
+// node of a Raft group) into a single aggregated profile written to
+// outPath.
+func mergeProfileFiles(paths []string, name, outPath string) (*manifestEntry, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no profiles to merge")
+	}
+
+	var profs []*profile.Profile
+	for _, p := range paths {
+		prof, err := readProfile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading %s: %s", p, err)
+		}
+		profs = append(profs, prof)
+	}
+
+	merged, err := profile.Merge(profs)
+	if err != nil {
+		return nil, fmt.Errorf("error while merging profiles: %s", err)
+	}
+
+	entry, err := writeProfile(merged, name, outPath)
+	if err != nil {
+		return nil, err
+	}
+	entry.Source = fmt.Sprintf("merge of %d profiles", len(paths))
+	return entry, nil
+}
+
+// isPprofProfile reports whether name is one of the pprof-parsable profile
+// types (as opposed to a JSON metric like "state" or "health", or "trace",
+// which is served from the same namespace but isn't in pprof's format at
+// all), i.e. whether it's worth attempting to parse and symbolize as a
+// pprof profile.
+func isPprofProfile(name string) bool {
+	for _, p := range pprofParsableProfileTypes {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// symbolizeEntry symbolizes the profile file described by entry in place
+// using f (the defaultFetcher if nil), updating its checksum and size to
+// reflect the rewritten file.
+func symbolizeEntry(ctx context.Context, f *Fetcher, addr string, entry *manifestEntry) error {
+	prof, err := readProfile(entry.File)
+	if err != nil {
+		return fmt.Errorf("error while reading profile %s: %s", entry.File, err)
+	}
+	if err := symbolizeProfile(ctx, f, addr, prof); err != nil {
+		return err
+	}
+
+	written, err := writeProfile(prof, entry.Name, entry.File)
+	if err != nil {
+		return err
+	}
+	entry.SHA256 = written.SHA256
+	entry.SizeBytes = written.SizeBytes
+	return nil
+}
+
+// symbolizeProfile resolves any location in prof that lacks line/function
+// info against addr's /debug/pprof/symbol endpoint via f (the
+// defaultFetcher if nil), mutating prof in place.
+func symbolizeProfile(ctx context.Context, f *Fetcher, addr string, prof *profile.Profile) error {
+	if f == nil {
+		f = defaultFetcher
+	}
+	u, err := url.Parse(addr)
+	if err != nil || (u.Host == "" && u.Scheme != "" && u.Scheme != "file") {
+		u, err = url.Parse("http://" + addr)
+	}
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("error while parsing address %s: %s", addr, err)
+	}
+
+	unresolved := make(map[uint64]bool)
+	for _, loc := range prof.Location {
+		if len(loc.Line) == 0 {
+			unresolved[loc.Address] = true
+		}
+	}
+	if len(unresolved) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	first := true
+	for a := range unresolved {
+		if !first {
+			body.WriteByte('+')
+		}
+		first = false
+		fmt.Fprintf(&body, "%#x", a)
+	}
+
+	resp, err := f.postRaw(ctx, fmt.Sprintf("%s/debug/pprof/symbol", u.String()), "text/plain", body.Bytes(), 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	symbols := map[uint64]string{}
+	scanner := bufio.NewScanner(resp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		a, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+		if err != nil {
+			glog.V(2).Infof("debuginfo: ignoring malformed symbol line %q: %s", scanner.Text(), err)
+			continue
+		}
+		symbols[a] = fields[1]
+	}
+
+	for _, loc := range prof.Location {
+		if len(loc.Line) > 0 {
+			continue
+		}
+		name, ok := symbols[loc.Address]
+		if !ok {
+			continue
+		}
+		loc.Line = []profile.Line{{Function: findOrAddFunction(prof, name)}}
+	}
+	return nil
+}
+
+// findOrAddFunction returns the existing *profile.Function named name, or
+// appends and returns a new one.
+func findOrAddFunction(prof *profile.Profile, name string) *profile.Function {
+	for _, f := range prof.Function {
+		if f.Name == name {
+			return f
+		}
+	}
+	var maxID uint64
+	for _, f := range prof.Function {
+		if f.ID > maxID {
+			maxID = f.ID
+		}
+	}
+	fn := &profile.Function{ID: maxID + 1, Name: name, SystemName: name}
+	prof.Function = append(prof.Function, fn)
+	return fn
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleProfile(value int64) *profile.Profile {
+	return &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "alloc_objects", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "space", Unit: "bytes"},
+		Sample:     []*profile.Sample{{Value: []int64{value}}},
+	}
+}
+
+func TestDiffProfiles(t *testing.T) {
+	base := sampleProfile(100)
+	curr := sampleProfile(150)
+
+	delta, err := diffProfiles(curr, base)
+	require.NoError(t, err)
+	require.Len(t, delta.Sample, 1)
+	require.Equal(t, int64(50), delta.Sample[0].Value[0])
+}
+
+func TestDiffProfilesNoGrowth(t *testing.T) {
+	base := sampleProfile(100)
+	curr := sampleProfile(100)
+
+	delta, err := diffProfiles(curr, base)
+	require.NoError(t, err)
+	// profile.Merge drops samples whose values all cancel out to zero.
+	require.Empty(t, delta.Sample)
+}
+
+func TestMergeProfileFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	path1 := filepath.Join(dir, "a.gz")
+	path2 := filepath.Join(dir, "b.gz")
+	_, err := writeProfile(sampleProfile(10), "heap", path1)
+	require.NoError(t, err)
+	_, err = writeProfile(sampleProfile(20), "heap", path2)
+	require.NoError(t, err)
+
+	outPath := filepath.Join(dir, "merged.gz")
+	entry, err := mergeProfileFiles([]string{path1, path2}, "heap-merged", outPath)
+	require.NoError(t, err)
+	require.Equal(t, "heap-merged", entry.Name)
+	require.Equal(t, outPath, entry.File)
+	require.Equal(t, "merge of 2 profiles", entry.Source)
+
+	merged, err := readProfile(outPath)
+	require.NoError(t, err)
+	require.Len(t, merged.Sample, 1)
+	require.Equal(t, int64(30), merged.Sample[0].Value[0])
+}
+
+func TestMergeProfileFilesNoPaths(t *testing.T) {
+	_, err := mergeProfileFiles(nil, "heap-merged", filepath.Join(t.TempDir(), "merged.gz"))
+	require.Error(t, err)
+}
+
+func TestIsPprofProfileExcludesTrace(t *testing.T) {
+	require.True(t, isPprofProfile("heap"))
+	require.True(t, isPprofProfile("goroutine"))
+	require.False(t, isPprofProfile("trace"))
+	require.False(t, isPprofProfile("state"))
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// triggerReason records why a Watcher fired a capture, and is stamped into
+// the file prefix of every profile it saves.
+type triggerReason string
+
+const (
+	reasonHeapThreshold triggerReason = "heap-threshold"
+	reasonHeapGrowth    triggerReason = "heap-growth"
+	reasonCPUThreshold  triggerReason = "cpu-threshold"
+)
+
+// WatcherConfig configures a Watcher.
+type WatcherConfig struct {
+	// Addr is the local Alpha/Zero debug endpoint the Watcher scrapes once
+	// it decides to capture. It is almost always the process's own
+	// "self" address.
+	Addr string
+	// PathPrefix is prepended to every file the Watcher writes, same
+	// convention as saveProfiles/saveMetrics.
+	PathPrefix string
+
+	// SampleInterval is how often runtime.MemStats and CPU usage are
+	// sampled. Defaults to 15s.
+	SampleInterval time.Duration
+	// MinInterval is the minimum time between two triggered captures,
+	// regardless of how many thresholds fire in between. Defaults to 10m.
+	MinInterval time.Duration
+	// CaptureDuration is how long the CPU profile taken on trigger runs
+	// for. Defaults to 10s.
+	CaptureDuration time.Duration
+
+	// HeapThresholdBytes triggers a capture once runtime.MemStats.HeapSys
+	// reaches this many bytes. Zero disables the check.
+	HeapThresholdBytes uint64
+	// HeapGrowthPercent triggers a capture once HeapSys grows by this
+	// percentage within GrowthWindow. Zero disables the check.
+	HeapGrowthPercent float64
+	// GrowthWindow is the sliding window HeapGrowthPercent is measured
+	// over. Defaults to 5m.
+	GrowthWindow time.Duration
+	// CPUThresholdPercent triggers a capture once process CPU usage
+	// (averaged since the last sample) reaches this percentage of one
+	// core's worth of work, e.g. 400 on an 8-core box means half the
+	// machine. Zero disables the check.
+	CPUThresholdPercent float64
+
+	// MaxArchives caps how many triggered dump files (.gz) are kept under
+	// PathPrefix's directory; the oldest are deleted once the cap is
+	// exceeded. Each file counts on its own, so a single capture uses up to
+	// three of them. Zero disables pruning.
+	MaxArchives int
+
+	// OnCapture, if set, is invoked after every successful triggered
+	// capture with the file prefix used and the trigger reason, so
+	// operators can wire up a webhook or exec hook to ship the dump
+	// elsewhere.
+	OnCapture func(prefix, reason string)
+}
+
+type memSample struct {
+	at      time.Time
+	heapSys uint64
+}
+
+// Watcher periodically samples the host process's memory and CPU usage and
+// automatically triggers a debuginfo capture (heap, goroutine, and a short
+// CPU profile) when a configured threshold is crossed. It is meant to be
+// started once from Alpha/Zero's startup path via Run.
+type Watcher struct {
+	cfg WatcherConfig
+
+	mu          sync.Mutex
+	capturing   bool
+	lastCapture time.Time
+	samples     []memSample
+	lastCPUTime time.Duration
+	lastCPUAt   time.Time
+}
+
+// NewWatcher builds a Watcher from cfg, filling in defaults for any unset
+// durations/limits.
+func NewWatcher(cfg WatcherConfig) *Watcher {
+	if cfg.SampleInterval == 0 {
+		cfg.SampleInterval = 15 * time.Second
+	}
+	if cfg.MinInterval == 0 {
+		cfg.MinInterval = 10 * time.Minute
+	}
+	if cfg.CaptureDuration == 0 {
+		cfg.CaptureDuration = 10 * time.Second
+	}
+	if cfg.GrowthWindow == 0 {
+		cfg.GrowthWindow = 5 * time.Minute
+	}
+	return &Watcher{cfg: cfg}
+}
+
+// Run samples memory and CPU usage every cfg.SampleInterval until ctx is
+// done, triggering captures as thresholds are crossed. Callers should run it
+// in its own goroutine.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.SampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.tick(ctx, now)
+		}
+	}
+}
+
+func (w *Watcher) tick(ctx context.Context, now time.Time) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	w.mu.Lock()
+	w.samples = append(w.samples, memSample{at: now, heapSys: ms.HeapSys})
+	w.samples = trimSamples(w.samples, now.Add(-w.cfg.GrowthWindow))
+	reason, triggered := w.checkThresholdsLocked(ms, now)
+	alreadyCapturing := w.capturing
+	sinceLast := now.Sub(w.lastCapture)
+	w.mu.Unlock()
+
+	if !triggered || alreadyCapturing {
+		return
+	}
+	if !w.lastCapture.IsZero() && sinceLast < w.cfg.MinInterval {
+		glog.V(2).Infof("debuginfo watcher: suppressing %s capture, last one was %s ago", reason, sinceLast)
+		return
+	}
+
+	go w.capture(ctx, reason)
+}
+
+// checkThresholdsLocked must be called with w.mu held.
+func (w *Watcher) checkThresholdsLocked(ms runtime.MemStats, now time.Time) (triggerReason, bool) {
+	if w.cfg.HeapThresholdBytes > 0 && ms.HeapSys >= w.cfg.HeapThresholdBytes {
+		return reasonHeapThreshold, true
+	}
+	if w.cfg.HeapGrowthPercent > 0 && len(w.samples) > 0 {
+		baseline := w.samples[0].heapSys
+		if baseline > 0 {
+			growth := (float64(ms.HeapSys) - float64(baseline)) / float64(baseline) * 100
+			if growth >= w.cfg.HeapGrowthPercent {
+				return reasonHeapGrowth, true
+			}
+		}
+	}
+	if w.cfg.CPUThresholdPercent > 0 {
+		if pct, ok := w.cpuPercentLocked(now); ok && pct >= w.cfg.CPUThresholdPercent {
+			return reasonCPUThreshold, true
+		}
+	}
+	return "", false
+}
+
+// cpuPercentLocked must be called with w.mu held.
+func (w *Watcher) cpuPercentLocked(now time.Time) (float64, bool) {
+	cpuTime, err := processCPUTime()
+	if err != nil {
+		return 0, false
+	}
+	prevTime, prevAt := w.lastCPUTime, w.lastCPUAt
+	w.lastCPUTime, w.lastCPUAt = cpuTime, now
+
+	if prevAt.IsZero() {
+		return 0, false
+	}
+	elapsed := now.Sub(prevAt)
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return (cpuTime - prevTime).Seconds() / elapsed.Seconds() * 100, true
+}
+
+// capture runs a single triggered dump. The capturing flag keeps overlapping
+// triggers from stampeding the process with concurrent CPU profiles. ctx is
+// Run's context, so canceling it (e.g. on shutdown) aborts an in-flight
+// capture instead of letting it run to completion.
+func (w *Watcher) capture(ctx context.Context, reason triggerReason) {
+	w.mu.Lock()
+	if w.capturing {
+		w.mu.Unlock()
+		return
+	}
+	w.capturing = true
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		w.capturing = false
+		w.lastCapture = time.Now()
+		w.mu.Unlock()
+	}()
+
+	glog.Infof("debuginfo watcher: triggered capture, reason=%s", reason)
+
+	ts := time.Now().UTC().Format("20060102T150405Z")
+	prefix := fmt.Sprintf("%s%s-%s-", w.cfg.PathPrefix, reason, ts)
+
+	entries := saveProfiles(ctx, nil, w.cfg.Addr, prefix, w.cfg.CaptureDuration,
+		[]string{"heap", "goroutine", "profile"})
+	if len(entries) == 0 {
+		glog.Errorf("debuginfo watcher: triggered capture for reason=%s produced nothing", reason)
+		return
+	}
+
+	if err := w.pruneOldArchives(); err != nil {
+		glog.Errorf("debuginfo watcher: error pruning old archives: %s", err)
+	}
+
+	if w.cfg.OnCapture != nil {
+		w.cfg.OnCapture(prefix, string(reason))
+	}
+}
+
+// pruneOldArchives deletes the oldest triggered dumps once more than
+// cfg.MaxArchives have accumulated next to PathPrefix. The glob is scoped to
+// files whose name starts with PathPrefix's own basename, so retention never
+// touches a ".gz" written by an unrelated collector (or a second Watcher)
+// sharing the same directory. A PathPrefix ending in a path separator has
+// an empty basename, so every ".gz" directly in that directory counts.
+func (w *Watcher) pruneOldArchives() error {
+	if w.cfg.MaxArchives <= 0 {
+		return nil
+	}
+
+	dir, base := filepath.Split(w.cfg.PathPrefix)
+	if dir == "" {
+		dir = "."
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, base+"*.gz"))
+	if err != nil {
+		return err
+	}
+	if len(matches) <= w.cfg.MaxArchives {
+		return nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		fi, errI := os.Stat(matches[i])
+		fj, errJ := os.Stat(matches[j])
+		if errI != nil || errJ != nil {
+			return false
+		}
+		return fi.ModTime().Before(fj.ModTime())
+	})
+
+	for _, path := range matches[:len(matches)-w.cfg.MaxArchives] {
+		if err := os.Remove(path); err != nil {
+			glog.Errorf("debuginfo watcher: error removing %s: %s", path, err)
+			continue
+		}
+		glog.Infof("debuginfo watcher: pruned old archive %s", path)
+	}
+	return nil
+}
+
+// trimSamples drops every sample older than cutoff, keeping the slice sorted
+// and bounded to the configured growth window.
+func trimSamples(samples []memSample, cutoff time.Time) []memSample {
+	i := 0
+	for i < len(samples) && samples[i].at.Before(cutoff) {
+		i++
+	}
+	return samples[i:]
+}
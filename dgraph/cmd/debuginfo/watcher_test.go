@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019-2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debuginfo
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckThresholdsLockedHeapThreshold(t *testing.T) {
+	w := &Watcher{cfg: WatcherConfig{HeapThresholdBytes: 1000}}
+
+	reason, triggered := w.checkThresholdsLocked(runtime.MemStats{HeapSys: 999}, time.Now())
+	require.False(t, triggered)
+	require.Empty(t, reason)
+
+	reason, triggered = w.checkThresholdsLocked(runtime.MemStats{HeapSys: 1000}, time.Now())
+	require.True(t, triggered)
+	require.Equal(t, reasonHeapThreshold, reason)
+}
+
+func TestCheckThresholdsLockedHeapGrowth(t *testing.T) {
+	now := time.Now()
+	w := &Watcher{cfg: WatcherConfig{HeapGrowthPercent: 50}}
+	w.samples = []memSample{{at: now.Add(-time.Minute), heapSys: 1000}}
+
+	reason, triggered := w.checkThresholdsLocked(runtime.MemStats{HeapSys: 1400}, now)
+	require.False(t, triggered)
+	require.Empty(t, reason)
+
+	reason, triggered = w.checkThresholdsLocked(runtime.MemStats{HeapSys: 1500}, now)
+	require.True(t, triggered)
+	require.Equal(t, reasonHeapGrowth, reason)
+}
+
+func TestCheckThresholdsLockedNoThresholdsConfigured(t *testing.T) {
+	w := &Watcher{}
+	reason, triggered := w.checkThresholdsLocked(runtime.MemStats{HeapSys: 1 << 30}, time.Now())
+	require.False(t, triggered)
+	require.Empty(t, reason)
+}
+
+func TestTrimSamples(t *testing.T) {
+	now := time.Now()
+	samples := []memSample{
+		{at: now.Add(-10 * time.Minute)},
+		{at: now.Add(-6 * time.Minute)},
+		{at: now.Add(-2 * time.Minute)},
+		{at: now},
+	}
+
+	trimmed := trimSamples(samples, now.Add(-5*time.Minute))
+	require.Len(t, trimmed, 2)
+	require.Equal(t, samples[2].at, trimmed[0].at)
+	require.Equal(t, samples[3].at, trimmed[1].at)
+}
+
+func TestTrimSamplesAllTooOld(t *testing.T) {
+	now := time.Now()
+	samples := []memSample{{at: now.Add(-10 * time.Minute)}, {at: now.Add(-8 * time.Minute)}}
+	require.Empty(t, trimSamples(samples, now))
+}